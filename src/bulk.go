@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+)
+
+// bulkMetaId is the "_id" field of an Elasticsearch-style bulk action
+// line, e.g. {"index":{"_id":"abc"}}.
+type bulkMetaId struct {
+	Id string `json:"_id"`
+}
+
+type bulkActionMeta struct {
+	Index  *bulkMetaId `json:"index"`
+	Create *bulkMetaId `json:"create"`
+	Update *bulkMetaId `json:"update"`
+	Delete *bulkMetaId `json:"delete"`
+}
+
+type bulkResult struct {
+	Id     string `json:"id"`
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// bulkPendingDocument tracks what id looks like after the lines of
+// this request processed so far, since a normal bulk payload can touch
+// the same id more than once (create then update, or two updates in a
+// row) before any of it is committed.
+type bulkPendingDocument struct {
+	exists   bool
+	document map[string]any
+}
+
+// priorDocument returns what id pointed at before this line, preferring
+// an earlier line's pending result over s.db so an op's deindex step
+// is run against the previous op's result within the same request,
+// not the pre-batch state that won't be visible until the batch
+// commits.
+func (s *Server) priorDocument(pending map[string]bulkPendingDocument, id string) (map[string]any, bool, error) {
+	if p, ok := pending[id]; ok {
+		return p.document, p.exists, nil
+	}
+
+	document, err := s.getDocumentById([]byte(id))
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return document, true, nil
+}
+
+// bulkDocuments implements POST /docs/_bulk: a newline-delimited JSON
+// body, either one document per line (each becomes a create) or
+// Elasticsearch-style action/metadata + source line pairs to support
+// create/update/delete in the same request. All primary-store and
+// index writes go into a single pebble.Batch per store, committed
+// together with pebble.Sync, instead of the per-document round trips
+// addDocument does.
+func (s *Server) bulkDocuments(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	dataBatch := s.db.NewBatch()
+	indexBatch := s.indexDb.NewIndexedBatch()
+
+	pending := map[string]bulkPendingDocument{}
+	var results []bulkResult
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var meta bulkActionMeta
+		if err := json.Unmarshal(line, &meta); err != nil {
+			results = append(results, bulkResult{Status: "error", Error: err.Error()})
+			continue
+		}
+
+		if meta.Delete != nil {
+			id := meta.Delete.Id
+
+			oldDocument, existed, err := s.priorDocument(pending, id)
+			if err != nil {
+				results = append(results, bulkResult{Id: id, Action: "delete", Status: "error", Error: err.Error()})
+				continue
+			}
+			if existed {
+				s.deindexInto(indexBatch, id, oldDocument)
+			}
+
+			if err := dataBatch.Delete([]byte(id), nil); err != nil {
+				results = append(results, bulkResult{Id: id, Action: "delete", Status: "error", Error: err.Error()})
+				continue
+			}
+			pending[id] = bulkPendingDocument{exists: false}
+			results = append(results, bulkResult{Id: id, Action: "delete", Status: "ok"})
+			continue
+		}
+
+		action, id := "create", ""
+		isActionLine := true
+		switch {
+		case meta.Create != nil:
+			id = meta.Create.Id
+		case meta.Update != nil:
+			action, id = "update", meta.Update.Id
+		case meta.Index != nil:
+			action, id = "index", meta.Index.Id
+		default:
+			isActionLine = false
+		}
+
+		source := line
+		if isActionLine {
+			if !scanner.Scan() {
+				results = append(results, bulkResult{Status: "error", Error: "expected a source line after bulk action metadata"})
+				break
+			}
+			source = scanner.Bytes()
+		}
+
+		var document map[string]any
+		if err := json.Unmarshal(source, &document); err != nil {
+			results = append(results, bulkResult{Action: action, Status: "error", Error: err.Error()})
+			continue
+		}
+
+		if id == "" {
+			id = uuid.New().String()
+		}
+
+		// Deindex whatever id currently points at (nil if it doesn't
+		// exist yet) before writing the new postings, the same
+		// deindex-then-index discipline replaceDocument uses, so an
+		// update/index action that changes a field's value doesn't
+		// leave the old value's postings behind. priorDocument checks
+		// pending first so a later line touching the same id deindexes
+		// against an earlier line's result in this request, not the
+		// stale pre-batch document.
+		oldDocument, existed, err := s.priorDocument(pending, id)
+		if err != nil {
+			results = append(results, bulkResult{Id: id, Action: action, Status: "error", Error: err.Error()})
+			continue
+		}
+		if existed {
+			s.deindexInto(indexBatch, id, oldDocument)
+		}
+
+		s.indexInto(indexBatch, id, document)
+
+		documentBytes, err := json.Marshal(document)
+		if err != nil {
+			results = append(results, bulkResult{Id: id, Action: action, Status: "error", Error: err.Error()})
+			continue
+		}
+
+		if err := dataBatch.Set([]byte(id), documentBytes, nil); err != nil {
+			results = append(results, bulkResult{Id: id, Action: action, Status: "error", Error: err.Error()})
+			continue
+		}
+
+		pending[id] = bulkPendingDocument{exists: true, document: document}
+		results = append(results, bulkResult{Id: id, Action: action, Status: "ok"})
+	}
+
+	if err := scanner.Err(); err != nil {
+		jsonResponse(w, nil, err)
+		return
+	}
+
+	if err := s.indexDb.Apply(indexBatch, pebble.Sync); err != nil {
+		jsonResponse(w, nil, err)
+		return
+	}
+	if err := s.db.Apply(dataBatch, pebble.Sync); err != nil {
+		jsonResponse(w, nil, err)
+		return
+	}
+
+	jsonResponse(w, map[string]any{
+		"results": results,
+		"count":   len(results),
+	}, nil)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const benchDocumentCount = 10000
+
+func newBenchServer(b *testing.B) *Server {
+	b.Helper()
+
+	s, err := newServer(b.TempDir()+"/doc_db.data", "0")
+	if err != nil {
+		b.Fatalf("newServer: %s", err)
+	}
+	b.Cleanup(func() {
+		s.db.Close()
+		s.indexDb.Close()
+	})
+
+	return s
+}
+
+// BenchmarkInsert10kViaDocs is the per-document /docs path: one
+// db.Set plus N indexDb.Get/Set round trips per document.
+func BenchmarkInsert10kViaDocs(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s := newBenchServer(b)
+
+		for j := 0; j < benchDocumentCount; j++ {
+			body, _ := json.Marshal(map[string]any{"name": fmt.Sprintf("doc%d", j), "age": float64(j % 100)})
+			req := httptest.NewRequest(http.MethodPost, "/docs", bytes.NewReader(body))
+			s.addDocument(httptest.NewRecorder(), req, nil)
+		}
+	}
+}
+
+// BenchmarkInsert10kViaBulk is the same 10k documents submitted as a
+// single /docs/_bulk request, which batches all primary-store and
+// index writes into one pebble.Batch per store.
+func BenchmarkInsert10kViaBulk(b *testing.B) {
+	var ndjson bytes.Buffer
+	for j := 0; j < benchDocumentCount; j++ {
+		body, _ := json.Marshal(map[string]any{"name": fmt.Sprintf("doc%d", j), "age": float64(j % 100)})
+		ndjson.Write(body)
+		ndjson.WriteByte('\n')
+	}
+	ndjsonBytes := ndjson.Bytes()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newBenchServer(b)
+
+		req := httptest.NewRequest(http.MethodPost, "/docs/_bulk", bytes.NewReader(ndjsonBytes))
+		s.bulkDocuments(httptest.NewRecorder(), req, nil)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func bulkTestDocuments(t *testing.T, s *Server, ndjson string) {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/docs/_bulk", strings.NewReader(ndjson))
+	w := httptest.NewRecorder()
+	s.bulkDocuments(w, req, nil)
+
+	var resp struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Body   struct {
+			Results []bulkResult `json:"results"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding bulkDocuments response %q: %s", w.Body.String(), err)
+	}
+	if resp.Status != "ok" {
+		t.Fatalf("bulkDocuments(%q) returned error: %s", ndjson, resp.Error)
+	}
+	for _, result := range resp.Body.Results {
+		if result.Status != "ok" {
+			t.Fatalf("bulkDocuments(%q) action %s %s failed: %s", ndjson, result.Action, result.Id, result.Error)
+		}
+	}
+}
+
+// TestBulkDeleteRemovesPostings guards against a bulk delete leaving
+// the deleted id's postings behind: a stale posting doesn't just make
+// search return an extra hit, it makes getDocumentById fail with
+// pebble.ErrNotFound partway through building the response, which
+// searchDocument treats as fatal.
+func TestBulkDeleteRemovesPostings(t *testing.T) {
+	s := newTestServer(t)
+
+	bulkTestDocuments(t, s, `{"index":{"_id":"doc1"}}
+{"name":"Kevin"}
+`)
+	bulkTestDocuments(t, s, `{"delete":{"_id":"doc1"}}
+`)
+
+	documents := searchTestDocuments(t, s, "name:Kevin")
+	if len(documents) != 0 {
+		t.Fatalf("expected no documents after bulk delete, got %v", documents)
+	}
+}
+
+// TestBulkUpdateDeindexesOldValue guards against a bulk update leaving
+// the previous value's postings behind, which would make stale field
+// values spuriously match.
+func TestBulkUpdateDeindexesOldValue(t *testing.T) {
+	s := newTestServer(t)
+
+	bulkTestDocuments(t, s, `{"index":{"_id":"doc1"}}
+{"name":"Kevin"}
+`)
+	bulkTestDocuments(t, s, `{"update":{"_id":"doc1"}}
+{"name":"Bob"}
+`)
+
+	if documents := searchTestDocuments(t, s, "name:Kevin"); len(documents) != 0 {
+		t.Fatalf("expected no documents matching the old value, got %v", documents)
+	}
+	if documents := searchTestDocuments(t, s, "name:Bob"); len(documents) != 1 {
+		t.Fatalf("expected 1 document matching the new value, got %v", documents)
+	}
+}
+
+// TestBulkSameIdTouchedTwiceInOneRequestDeindexesAgainstPriorLine
+// guards against deindexing an id's later line in the same bulk
+// payload against the pre-batch document: getDocumentById only sees
+// committed state, so without per-id pending tracking every lookup
+// after the first one in a request sees the same stale document, and
+// the second op's deindex step removes the wrong postings.
+func TestBulkSameIdTouchedTwiceInOneRequestDeindexesAgainstPriorLine(t *testing.T) {
+	s := newTestServer(t)
+
+	bulkTestDocuments(t, s, `{"index":{"_id":"doc1"}}
+{"name":"Kevin"}
+{"update":{"_id":"doc1"}}
+{"name":"Bob"}
+`)
+
+	if documents := searchTestDocuments(t, s, "name:Kevin"); len(documents) != 0 {
+		t.Fatalf("expected no documents matching the superseded value, got %v", documents)
+	}
+	if documents := searchTestDocuments(t, s, "name:Bob"); len(documents) != 1 {
+		t.Fatalf("expected 1 document matching the final value, got %v", documents)
+	}
+}
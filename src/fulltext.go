@@ -0,0 +1,580 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// BM25 parameters, see Robertson & Zaragoza, "The Probabilistic
+// Relevance Framework: BM25 and Beyond".
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+
+	snippetContext = 30
+)
+
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "for": true, "in": true, "is": true, "it": true,
+	"of": true, "on": true, "or": true, "that": true, "the": true, "this": true,
+	"to": true, "with": true,
+}
+
+// tokenize lowercases s and splits it into Unicode-aware words,
+// dropping stopwords.
+func tokenize(s string) []string {
+	var tokens []string
+	var cur []rune
+
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		word := strings.ToLower(string(cur))
+		if !stopwords[word] {
+			tokens = append(tokens, word)
+		}
+		cur = cur[:0]
+	}
+
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			cur = append(cur, r)
+		} else {
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+func fullTextPostingsKey(path, term string) []byte {
+	return []byte(fmt.Sprintf("ft/%s/%s", path, term))
+}
+
+func fullTextDfKey(term string) []byte {
+	return []byte(fmt.Sprintf("ft_df/%s", term))
+}
+
+func fullTextLenKey(id string) []byte {
+	return []byte(fmt.Sprintf("ft_len/%s", id))
+}
+
+// indexText tokenizes the text found at path in document id and
+// records per-token postings, document-frequency counters, and the
+// document's token length, so that field can later be searched with
+// the `~` full-text operator.
+func (s *Server) indexText(w pebbleReadWriter, id string, pathValues []pathValue) {
+	var allTokens []string
+	byPath := map[string][]string{}
+
+	for _, pv := range pathValues {
+		text, ok := pv.value.(string)
+		if !ok {
+			continue
+		}
+
+		tokens := tokenize(text)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		byPath[pv.path] = append(byPath[pv.path], tokens...)
+		allTokens = append(allTokens, tokens...)
+	}
+
+	if len(allTokens) == 0 {
+		return
+	}
+
+	for path, tokens := range byPath {
+		seen := map[string]bool{}
+		for _, term := range tokens {
+			if seen[term] {
+				continue
+			}
+			seen[term] = true
+
+			if err := addPosting(w, fullTextPostingsKey(path, term), id); err != nil {
+				log.Printf("Could not update full-text index: %s", err)
+			}
+		}
+	}
+
+	// a document that already has a length entry has had its terms
+	// counted, so re-running indexText over it (as reIndex does on
+	// every start) leaves the document frequencies as they are
+	lenKey := fullTextLenKey(id)
+	alreadyCounted := false
+	if _, closer, err := w.Get(lenKey); err == nil {
+		closer.Close()
+		alreadyCounted = true
+	}
+
+	seenGlobal := map[string]bool{}
+	for _, term := range allTokens {
+		if alreadyCounted || seenGlobal[term] {
+			continue
+		}
+		seenGlobal[term] = true
+
+		if err := incrCounter(w, fullTextDfKey(term), 1); err != nil {
+			log.Printf("Could not update document frequency for %q: %s", term, err)
+		}
+	}
+
+	if err := w.Set(lenKey, []byte(strconv.Itoa(len(allTokens))), pebble.Sync); err != nil {
+		log.Printf("Could not set document length for %q: %s", id, err)
+	}
+}
+
+// deindexText is the inverse of indexText: it removes id from every
+// posting and document-frequency counter indexText(w, id, pathValues)
+// would have touched, and drops its length entry.
+func (s *Server) deindexText(w pebbleReadWriter, id string, pathValues []pathValue) {
+	var allTokens []string
+	byPath := map[string][]string{}
+
+	for _, pv := range pathValues {
+		text, ok := pv.value.(string)
+		if !ok {
+			continue
+		}
+
+		tokens := tokenize(text)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		byPath[pv.path] = append(byPath[pv.path], tokens...)
+		allTokens = append(allTokens, tokens...)
+	}
+
+	if len(allTokens) == 0 {
+		return
+	}
+
+	for path, tokens := range byPath {
+		seen := map[string]bool{}
+		for _, term := range tokens {
+			if seen[term] {
+				continue
+			}
+			seen[term] = true
+
+			if _, err := removePosting(w, fullTextPostingsKey(path, term), id); err != nil {
+				log.Printf("Could not update full-text index: %s", err)
+			}
+		}
+	}
+
+	seenGlobal := map[string]bool{}
+	for _, term := range allTokens {
+		if seenGlobal[term] {
+			continue
+		}
+		seenGlobal[term] = true
+
+		if err := incrCounter(w, fullTextDfKey(term), -1); err != nil {
+			log.Printf("Could not update document frequency for %q: %s", term, err)
+		}
+	}
+
+	if err := w.Delete(fullTextLenKey(id), pebble.Sync); err != nil {
+		log.Printf("Could not delete document length for %q: %s", id, err)
+	}
+}
+
+// addPosting appends id to the csv id list stored at key, skipping it
+// if it's already present.
+func addPosting(w pebbleReadWriter, key []byte, id string) error {
+	idsString, closer, err := w.Get(key)
+	if err != nil && err != pebble.ErrNotFound {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	if len(idsString) == 0 {
+		return w.Set(key, []byte(id), pebble.Sync)
+	}
+
+	for _, existingId := range strings.Split(string(idsString), ",") {
+		if existingId == id {
+			return nil
+		}
+	}
+
+	return w.Set(key, append(append([]byte{}, idsString...), ","+id...), pebble.Sync)
+}
+
+// removePosting removes id from the csv id list stored at key,
+// deleting the key entirely if id was the last entry. found is false
+// if id wasn't present (including when key didn't exist at all).
+func removePosting(w pebbleReadWriter, key []byte, id string) (found bool, err error) {
+	idsString, closer, err := w.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	defer closer.Close()
+
+	var remaining []string
+	for _, existingId := range strings.Split(string(idsString), ",") {
+		if existingId == id {
+			found = true
+			continue
+		}
+		remaining = append(remaining, existingId)
+	}
+	if !found {
+		return false, nil
+	}
+
+	if len(remaining) == 0 {
+		return true, w.Delete(key, pebble.Sync)
+	}
+	return true, w.Set(key, []byte(strings.Join(remaining, ",")), pebble.Sync)
+}
+
+func incrCounter(w pebbleReadWriter, key []byte, delta int) error {
+	valueBytes, closer, err := w.Get(key)
+	if err != nil && err != pebble.ErrNotFound {
+		return err
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
+
+	n := 0
+	if len(valueBytes) > 0 {
+		n, err = strconv.Atoi(string(valueBytes))
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Set(key, []byte(strconv.Itoa(n+delta)), pebble.Sync)
+}
+
+func (s *Server) getCounter(key []byte) (int, error) {
+	valueBytes, closer, err := s.indexDb.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer closer.Close()
+
+	return strconv.Atoi(string(valueBytes))
+}
+
+// gcFullTextPostings drops ids no longer present in s.db from every
+// ft/ posting list, decrementing that term's document frequency once
+// per id removed, and deletes any now-orphaned ft_len/ entry. Like
+// gcIndexPostings, the ids to remove are collected before any writes
+// so the cleanup doesn't mutate the index mid-iteration.
+func (s *Server) gcFullTextPostings() {
+	postingsPrefix := []byte("ft/")
+	it, err := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: postingsPrefix, UpperBound: prefixUpperBound(postingsPrefix)})
+	if err != nil {
+		log.Printf("Unable to create iterator for full-text GC: %s", err)
+		return
+	}
+
+	type stalePosting struct {
+		key      []byte
+		term     string
+		staleIds []string
+	}
+	var stale []stalePosting
+
+	for it.First(); it.Valid(); it.Next() {
+		parts := strings.SplitN(string(it.Key()), "/", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		term := parts[2]
+
+		var staleIds []string
+		for _, id := range strings.Split(string(it.Value()), ",") {
+			if !s.documentExists(id) {
+				staleIds = append(staleIds, id)
+			}
+		}
+		if len(staleIds) > 0 {
+			stale = append(stale, stalePosting{key: append([]byte{}, it.Key()...), term: term, staleIds: staleIds})
+		}
+	}
+	it.Close()
+
+	for _, sp := range stale {
+		for _, id := range sp.staleIds {
+			if _, err := removePosting(s.indexDb, sp.key, id); err != nil {
+				log.Printf("Could not remove stale full-text posting %q: %s", sp.key, err)
+				continue
+			}
+			if err := incrCounter(s.indexDb, fullTextDfKey(sp.term), -1); err != nil {
+				log.Printf("Could not update document frequency for %q: %s", sp.term, err)
+			}
+		}
+	}
+
+	lenPrefix := []byte("ft_len/")
+	lenIt, err := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: lenPrefix, UpperBound: prefixUpperBound(lenPrefix)})
+	if err != nil {
+		log.Printf("Unable to create iterator for full-text GC: %s", err)
+		return
+	}
+
+	var staleLenKeys [][]byte
+	for lenIt.First(); lenIt.Valid(); lenIt.Next() {
+		id := strings.TrimPrefix(string(lenIt.Key()), "ft_len/")
+		if !s.documentExists(id) {
+			staleLenKeys = append(staleLenKeys, append([]byte{}, lenIt.Key()...))
+		}
+	}
+	lenIt.Close()
+
+	for _, key := range staleLenKeys {
+		if err := s.indexDb.Delete(key, pebble.Sync); err != nil {
+			log.Printf("Could not remove stale document length %q: %s", key, err)
+		}
+	}
+}
+
+// fullTextMatch describes where and how a full-text query matched one
+// document, in the "match level / matched words / value" shape common
+// to search-service DTOs.
+type fullTextMatch struct {
+	Field        string   `json:"field"`
+	MatchedTerms []string `json:"matchedTerms"`
+	Snippet      string   `json:"snippet"`
+}
+
+type fullTextHit struct {
+	id      string
+	score   float64
+	matches []fullTextMatch
+}
+
+// fullTextSearch runs a BM25-ranked search for phrase against path,
+// returning hits sorted by descending score.
+func (s *Server) fullTextSearch(path, phrase string) ([]fullTextHit, error) {
+	terms := tokenize(phrase)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	candidates, err := s.intersectPostings(path, terms)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	totalDocs, totalLen, err := s.fullTextCorpusStats()
+	if err != nil {
+		return nil, err
+	}
+	if totalDocs == 0 {
+		return nil, nil
+	}
+	avgDocLen := float64(totalLen) / float64(totalDocs)
+
+	dfByTerm := map[string]int{}
+	for _, term := range terms {
+		df, err := s.getCounter(fullTextDfKey(term))
+		if err != nil {
+			return nil, err
+		}
+		dfByTerm[term] = df
+	}
+
+	var hits []fullTextHit
+	for _, id := range candidates {
+		document, err := s.getDocumentById([]byte(id))
+		if err != nil {
+			return nil, err
+		}
+
+		values, ok := getPath(document, strings.Split(path, "."))
+		if !ok {
+			continue
+		}
+
+		var text string
+		for _, value := range values {
+			if t, ok := value.(string); ok {
+				text = t
+				break
+			}
+		}
+		if text == "" {
+			continue
+		}
+
+		docLen, err := s.getCounter(fullTextLenKey(id))
+		if err != nil {
+			return nil, err
+		}
+
+		fieldTokens := tokenize(text)
+		score := 0.0
+		var matchedTerms []string
+		for _, term := range terms {
+			tf := 0
+			for _, token := range fieldTokens {
+				if token == term {
+					tf++
+				}
+			}
+			if tf == 0 {
+				continue
+			}
+			matchedTerms = append(matchedTerms, term)
+
+			df := dfByTerm[term]
+			idf := math.Log((float64(totalDocs-df)+0.5)/(float64(df)+0.5) + 1)
+			numerator := float64(tf) * (bm25K1 + 1)
+			denominator := float64(tf) + bm25K1*(1-bm25B+bm25B*float64(docLen)/avgDocLen)
+			score += idf * numerator / denominator
+		}
+
+		if len(matchedTerms) == 0 {
+			continue
+		}
+
+		hits = append(hits, fullTextHit{
+			id:    id,
+			score: score,
+			matches: []fullTextMatch{{
+				Field:        path,
+				MatchedTerms: matchedTerms,
+				Snippet:      highlightSnippet(text, matchedTerms),
+			}},
+		})
+	}
+
+	sort.Slice(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+
+	return hits, nil
+}
+
+// intersectPostings returns the ids present in every ft/<path>/<term>
+// posting list for terms.
+func (s *Server) intersectPostings(path string, terms []string) ([]string, error) {
+	counts := map[string]int{}
+	for _, term := range terms {
+		ids, err := s.lookupPosting(fullTextPostingsKey(path, term))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			counts[id]++
+		}
+	}
+
+	var ids []string
+	for id, count := range counts {
+		if count == len(terms) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (s *Server) lookupPosting(key []byte) ([]string, error) {
+	idsString, closer, err := s.indexDb.Get(key)
+	if err != nil {
+		if err == pebble.ErrNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not look up posting [%#v]: %s", string(key), err)
+	}
+	defer closer.Close()
+
+	if len(idsString) == 0 {
+		return nil, nil
+	}
+
+	return strings.Split(string(idsString), ","), nil
+}
+
+// fullTextCorpusStats returns the number of documents that have been
+// full-text indexed and the sum of their token lengths, used for the
+// BM25 idf and average-document-length terms.
+func (s *Server) fullTextCorpusStats() (int, int, error) {
+	prefix := []byte("ft_len/")
+	it, err := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer it.Close()
+
+	docs, totalLen := 0, 0
+	for it.First(); it.Valid(); it.Next() {
+		n, err := strconv.Atoi(string(it.Value()))
+		if err != nil {
+			continue
+		}
+		docs++
+		totalLen += n
+	}
+
+	return docs, totalLen, nil
+}
+
+// highlightSnippet wraps the first occurrence of any matched term in
+// <em> tags and keeps ~snippetContext characters of context on either
+// side.
+func highlightSnippet(text string, matchedTerms []string) string {
+	lower := strings.ToLower(text)
+
+	matchStart, matchEnd := -1, -1
+	for _, term := range matchedTerms {
+		if idx := strings.Index(lower, term); idx != -1 {
+			if matchStart == -1 || idx < matchStart {
+				matchStart, matchEnd = idx, idx+len(term)
+			}
+		}
+	}
+	if matchStart == -1 {
+		return ""
+	}
+
+	start := matchStart - snippetContext
+	if start < 0 {
+		start = 0
+	}
+	end := matchEnd + snippetContext
+	if end > len(text) {
+		end = len(text)
+	}
+
+	prefix := ""
+	if start > 0 {
+		prefix = "..."
+	}
+	suffix := ""
+	if end < len(text) {
+		suffix = "..."
+	}
+
+	return prefix + text[start:matchStart] + "<em>" + text[matchStart:matchEnd] + "</em>" + text[matchEnd:end] + suffix
+}
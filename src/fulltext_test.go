@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenizeLowercasesSplitsAndDropsStopwords(t *testing.T) {
+	got := tokenize("The Quick-Brown Fox, jumps over THE lazy dog!")
+	want := []string{"quick", "brown", "fox", "jumps", "over", "lazy", "dog"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tokenize(...) = %v, want %v", got, want)
+	}
+}
+
+func TestHighlightSnippetWrapsFirstMatchWithContext(t *testing.T) {
+	text := strings.Repeat("x", 40) + " quick brown fox " + strings.Repeat("y", 40)
+
+	snippet := highlightSnippet(text, []string{"brown"})
+
+	if !strings.Contains(snippet, "<em>brown</em>") {
+		t.Fatalf("highlightSnippet(...) = %q, missing <em>brown</em>", snippet)
+	}
+	if !strings.HasPrefix(snippet, "...") || !strings.HasSuffix(snippet, "...") {
+		t.Fatalf("highlightSnippet(...) = %q, want leading and trailing ellipsis", snippet)
+	}
+}
+
+func TestHighlightSnippetNoMatchReturnsEmpty(t *testing.T) {
+	if got := highlightSnippet("hello world", []string{"missing"}); got != "" {
+		t.Fatalf("highlightSnippet(no match) = %q, want empty string", got)
+	}
+}
+
+func TestIndexTextTracksDocumentFrequencyAndLength(t *testing.T) {
+	s := newTestServer(t)
+
+	pathValues := getPathValues(map[string]any{"body": "quick brown fox"}, "")
+	s.indexText(s.indexDb, "doc1", pathValues)
+
+	df, err := s.getCounter(fullTextDfKey("quick"))
+	if err != nil {
+		t.Fatalf("getCounter(df quick): %s", err)
+	}
+	if df != 1 {
+		t.Fatalf("df(quick) = %d, want 1", df)
+	}
+
+	length, err := s.getCounter(fullTextLenKey("doc1"))
+	if err != nil {
+		t.Fatalf("getCounter(len doc1): %s", err)
+	}
+	if length != 3 {
+		t.Fatalf("len(doc1) = %d, want 3", length)
+	}
+
+	s.deindexText(s.indexDb, "doc1", pathValues)
+
+	df, err = s.getCounter(fullTextDfKey("quick"))
+	if err != nil {
+		t.Fatalf("getCounter(df quick) after deindex: %s", err)
+	}
+	if df != 0 {
+		t.Fatalf("df(quick) after deindex = %d, want 0", df)
+	}
+
+	length, err = s.getCounter(fullTextLenKey("doc1"))
+	if err != nil {
+		t.Fatalf("getCounter(len doc1) after deindex: %s", err)
+	}
+	if length != 0 {
+		t.Fatalf("len(doc1) after deindex = %d, want 0 (key deleted)", length)
+	}
+}
+
+// TestFullTextSearchRanksByBM25AndHighlightsSnippet exercises the `~`
+// query end to end: posting-list intersection narrows candidates to
+// documents containing every term, BM25 ranks the higher-tf/shorter
+// document first, and each hit carries a highlighted snippet.
+func TestFullTextSearchRanksByBM25AndHighlightsSnippet(t *testing.T) {
+	s := newTestServer(t)
+
+	addTestDocument(t, s, map[string]any{"title": "the quick brown fox jumps over the lazy dog"})
+	addTestDocument(t, s, map[string]any{"title": "quick quick quick brown fox"})
+	addTestDocument(t, s, map[string]any{"title": "completely unrelated text"})
+
+	documents := searchTestDocuments(t, s, `title:~"quick brown"`)
+
+	if len(documents) != 2 {
+		t.Fatalf("expected 2 documents to match, got %d: %v", len(documents), documents)
+	}
+
+	top, _ := documents[0]["body"].(map[string]any)
+	if top["title"] != "quick quick quick brown fox" {
+		t.Fatalf("expected the higher-tf, shorter document ranked first, got %v", top)
+	}
+
+	topScore, _ := documents[0]["score"].(float64)
+	secondScore, _ := documents[1]["score"].(float64)
+	if topScore <= secondScore {
+		t.Fatalf("expected top score %v > second score %v", topScore, secondScore)
+	}
+
+	matches, _ := documents[0]["matches"].([]any)
+	if len(matches) != 1 {
+		t.Fatalf("expected 1 match entry, got %v", documents[0]["matches"])
+	}
+	match, _ := matches[0].(map[string]any)
+	if match["field"] != "title" {
+		t.Fatalf("match field = %v, want title", match["field"])
+	}
+	if !strings.Contains(match["snippet"].(string), "<em>") {
+		t.Fatalf("match snippet = %v, want highlighted terms", match["snippet"])
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Numeric index keys are written so that a Pebble iterator can walk
+// them in value order, which is what lets range predicates (`<`, `>`)
+// be served from the index instead of falling back to a full scan.
+// String keys are length-prefixed (see appendEncodedString), so they
+// sort by length first and serve equality lookups only:
+//
+//	idx/<path>/n/<8-byte big-endian sortable float64>/<id>          -> nil
+//	idx/<path>/s/<4-byte big-endian length><value>/<id>             -> nil
+//
+// The id is part of the key rather than a csv value, so adding or
+// removing a posting is a single Set/Delete instead of a read-modify-
+// write of a shared value.
+const (
+	indexTagNumber = "n"
+	indexTagString = "s"
+)
+
+// pathValue is one (dotted path, leaf value) pair extracted from a
+// document, ready to be written into the index.
+type pathValue struct {
+	path  string
+	value any // float64 or string
+}
+
+func indexPrefix(path, tag string) []byte {
+	return []byte(fmt.Sprintf("idx/%s/%s/", path, tag))
+}
+
+// encodeNumber maps v to an 8-byte representation that sorts in the
+// same order as the underlying float64, including negative values:
+// flip the sign bit for non-negatives, flip every bit for negatives.
+// NaN has no defined order, so callers must not index NaN values.
+func encodeNumber(v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, bits)
+	return buf
+}
+
+func numberIndexKey(path string, v float64, id string) []byte {
+	key := indexPrefix(path, indexTagNumber)
+	key = append(key, encodeNumber(v)...)
+	key = append(key, '/')
+	key = append(key, id...)
+	return key
+}
+
+func stringIndexKey(path, value, id string) []byte {
+	key := indexPrefix(path, indexTagString)
+	key = appendEncodedString(key, value)
+	key = append(key, '/')
+	key = append(key, id...)
+	return key
+}
+
+// appendEncodedString appends a 4-byte big-endian length prefix
+// followed by s to dst. Without the length prefix, a value containing
+// '/' would be indistinguishable from a path continuation: the key
+// for value "x/y" would share a prefix with the key for value "x",
+// making an equality lookup for "x" wrongly match a posting for "x/y"
+// too. The length prefix guarantees two different-length values never
+// share a common key prefix, the same way the fixed-width numeric
+// encoding avoids the problem for numbers.
+func appendEncodedString(dst []byte, s string) []byte {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(s)))
+	dst = append(dst, lenBuf[:]...)
+	return append(dst, s...)
+}
+
+// prefixUpperBound returns the smallest key that is greater than every
+// key starting with prefix, for use as a Pebble IterOptions.UpperBound.
+// Returns nil if prefix is empty or all 0xff (no such bound exists).
+func prefixUpperBound(prefix []byte) []byte {
+	upper := make([]byte, len(prefix))
+	copy(upper, prefix)
+	for i := len(upper) - 1; i >= 0; i-- {
+		upper[i]++
+		if upper[i] != 0 {
+			return upper[:i+1]
+		}
+	}
+	return nil
+}
+
+// pebbleReadWriter is satisfied by both *pebble.DB and an indexed
+// *pebble.Batch, so indexing code can write either straight to the
+// index database or into a batch to be committed later (see bulk.go).
+type pebbleReadWriter interface {
+	pebble.Reader
+	pebble.Writer
+}
+
+func (s *Server) index(id string, document map[string]any) {
+	s.indexInto(s.indexDb, id, document)
+}
+
+func (s *Server) indexInto(w pebbleReadWriter, id string, document map[string]any) {
+	pathValues := getPathValues(document, "")
+
+	for _, pv := range pathValues {
+		var key []byte
+		switch v := pv.value.(type) {
+		case float64:
+			key = numberIndexKey(pv.path, v, id)
+		default:
+			key = stringIndexKey(pv.path, fmt.Sprint(pv.value), id)
+		}
+
+		if err := w.Set(key, nil, pebble.Sync); err != nil {
+			log.Printf("Could not update index: %s", err)
+		}
+	}
+
+	s.indexText(w, id, pathValues)
+}
+
+// deindexInto is the inverse of indexInto: it removes every posting
+// that indexInto(w, id, document) would have written, so the index
+// doesn't keep pointing at a document that's about to be replaced or
+// deleted. Callers are expected to follow it with indexInto(w, id,
+// newDocument) (update/patch) or nothing at all (delete).
+func (s *Server) deindexInto(w pebbleReadWriter, id string, document map[string]any) {
+	pathValues := getPathValues(document, "")
+
+	for _, pv := range pathValues {
+		var key []byte
+		switch v := pv.value.(type) {
+		case float64:
+			key = numberIndexKey(pv.path, v, id)
+		default:
+			key = stringIndexKey(pv.path, fmt.Sprint(pv.value), id)
+		}
+
+		if err := w.Delete(key, pebble.Sync); err != nil {
+			log.Printf("Could not remove from index: %s", err)
+		}
+	}
+
+	s.deindexText(w, id, pathValues)
+}
+
+// replaceDocument atomically swaps id's stored document for
+// newDocument: the old document's postings are removed, newDocument's
+// postings are written, and the primary store is updated, with each
+// store's writes in a single batch. The two batches are applied one
+// after the other, index first, so a crash between the two Apply
+// calls can leave the index out of step with the primary store.
+// oldDocument may be nil (nothing to deindex), which makes this double
+// as an upsert.
+func (s *Server) replaceDocument(id string, oldDocument, newDocument map[string]any) error {
+	dataBatch := s.db.NewBatch()
+	indexBatch := s.indexDb.NewIndexedBatch()
+
+	s.deindexInto(indexBatch, id, oldDocument)
+	s.indexInto(indexBatch, id, newDocument)
+
+	documentBytes, err := json.Marshal(newDocument)
+	if err != nil {
+		return err
+	}
+	if err := dataBatch.Set([]byte(id), documentBytes, nil); err != nil {
+		return err
+	}
+
+	if err := s.indexDb.Apply(indexBatch, pebble.Sync); err != nil {
+		return err
+	}
+	return s.db.Apply(dataBatch, pebble.Sync)
+}
+
+// removeDocument atomically deindexes oldDocument and deletes id from
+// the primary store, using the same batch-pair discipline as
+// replaceDocument.
+func (s *Server) removeDocument(id string, oldDocument map[string]any) error {
+	dataBatch := s.db.NewBatch()
+	indexBatch := s.indexDb.NewIndexedBatch()
+
+	s.deindexInto(indexBatch, id, oldDocument)
+
+	if err := dataBatch.Delete([]byte(id), nil); err != nil {
+		return err
+	}
+
+	if err := s.indexDb.Apply(indexBatch, pebble.Sync); err != nil {
+		return err
+	}
+	return s.db.Apply(dataBatch, pebble.Sync)
+}
+
+func getPathValues(obj map[string]any, prefix string) []pathValue {
+	var pathValues []pathValue
+	for key, value := range obj {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		pathValues = append(pathValues, flattenPathValue(path, value)...)
+	}
+
+	return pathValues
+}
+
+// flattenPathValue turns a single JSON value living at path into zero
+// or more pathValues: a nested object recurses one level deeper, an
+// array emits one entry per element at the *same* path - matching
+// Elasticsearch's flattened array semantics, so `{"tags":["go","db"]}`
+// produces `tags=go` and `tags=db`, and `{"authors":[{"name":"Phil"}]}`
+// produces `authors.name=Phil` - and anything else is a leaf value.
+func flattenPathValue(path string, value any) []pathValue {
+	switch t := value.(type) {
+	case map[string]any:
+		return getPathValues(t, path)
+	case []interface{}:
+		var pathValues []pathValue
+		for _, elem := range t {
+			pathValues = append(pathValues, flattenPathValue(path, elem)...)
+		}
+		return pathValues
+	case float64:
+		if math.IsNaN(t) {
+			// NaN has no sort order, so it can't live in the numeric
+			// index; fall through to string indexing.
+			return []pathValue{{path: path, value: fmt.Sprint(value)}}
+		}
+		return []pathValue{{path: path, value: t}}
+	default:
+		return []pathValue{{path: path, value: fmt.Sprint(value)}}
+	}
+}
+
+// lookupEqual returns the ids of documents whose value at path equals
+// value (a float64 or a string), using the equality-index keys.
+func (s *Server) lookupEqual(path string, value any) ([]string, error) {
+	var exact []byte
+	switch v := value.(type) {
+	case float64:
+		exact = indexPrefix(path, indexTagNumber)
+		exact = append(exact, encodeNumber(v)...)
+	default:
+		exact = indexPrefix(path, indexTagString)
+		exact = appendEncodedString(exact, fmt.Sprint(value))
+	}
+	exact = append(exact, '/')
+
+	return s.scanIds(exact, prefixUpperBound(exact))
+}
+
+// lookupRange returns the ids of documents whose numeric value at path
+// satisfies `value op` (op is "<" or ">").
+func (s *Server) lookupRange(path string, op string, value float64) ([]string, error) {
+	numPrefix := indexPrefix(path, indexTagNumber)
+	lower, upper := numPrefix, prefixUpperBound(numPrefix)
+
+	exact := append(append([]byte{}, numPrefix...), encodeNumber(value)...)
+	switch op {
+	case ">":
+		lower = prefixUpperBound(exact)
+	case "<":
+		upper = exact
+	}
+
+	return s.scanIds(lower, upper)
+}
+
+// scanIds collects the distinct ids trailing every key in [lower,
+// upper). A dedup pass is required, not just nice to have: a document
+// with an array field emits one posting per element (see
+// flattenPathValue), so a single id can have several keys fall inside
+// a range scan - e.g. {"scores":[20,50]} against scores:>10 - and
+// without it callers would get that id back once per matching
+// element.
+func (s *Server) scanIds(lower, upper []byte) ([]string, error) {
+	it, err := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+	if err != nil {
+		return nil, fmt.Errorf("Could not scan index [%s, %s): %s", lower, upper, err)
+	}
+	defer it.Close()
+
+	seen := map[string]bool{}
+	var ids []string
+	for it.First(); it.Valid(); it.Next() {
+		key := it.Key()
+		idx := bytes.LastIndexByte(key, '/')
+		if idx == -1 {
+			continue
+		}
+
+		id := string(key[idx+1:])
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// to handle documents that were ingested and not indexed, or to
+// rebuild the index after a key format change
+func (s *Server) reIndex() {
+	it, err := s.db.NewIter(nil)
+	if err != nil {
+		log.Printf("Unable to creater iterator for db: %s", err)
+	}
+	defer it.Close()
+
+	for it.First(); it.Valid(); it.Next() {
+		var document map[string]any
+		err := json.Unmarshal(it.Value(), &document)
+		if err != nil {
+			log.Printf("Unable to parse bad document, %s: %s", string(it.Key()), err)
+		}
+
+		s.index(string(it.Key()), document)
+	}
+}
+
+// reIndexAndGC is reIndex plus a pass that drops postings referencing
+// ids no longer present in s.db - such as the ones a crash between
+// the index and primary writes of replaceDocument or bulkDocuments
+// leaves behind for a document that was being created - which would
+// otherwise stay forever, since reIndex alone only ever adds
+// postings, never removes them.
+func (s *Server) reIndexAndGC() {
+	s.gcStalePostings()
+	s.reIndex()
+}
+
+// documentExists reports whether id is still present in the primary
+// store.
+func (s *Server) documentExists(id string) bool {
+	_, closer, err := s.db.Get([]byte(id))
+	if err != nil {
+		return false
+	}
+	closer.Close()
+	return true
+}
+
+// gcStalePostings removes every posting - equality/range index key or
+// full-text posting - whose id is missing from s.db.
+func (s *Server) gcStalePostings() {
+	s.gcIndexPostings()
+	s.gcFullTextPostings()
+}
+
+// gcIndexPostings drops idx/ keys (see the key format comment above)
+// whose trailing id no longer has a document in s.db. Stale keys are
+// collected before any are deleted so the delete pass doesn't mutate
+// the index out from under the iterator.
+func (s *Server) gcIndexPostings() {
+	prefix := []byte("idx/")
+	it, err := s.indexDb.NewIter(&pebble.IterOptions{LowerBound: prefix, UpperBound: prefixUpperBound(prefix)})
+	if err != nil {
+		log.Printf("Unable to create iterator for index GC: %s", err)
+		return
+	}
+	defer it.Close()
+
+	var stale [][]byte
+	for it.First(); it.Valid(); it.Next() {
+		key := it.Key()
+		idx := bytes.LastIndexByte(key, '/')
+		if idx == -1 {
+			continue
+		}
+
+		if id := string(key[idx+1:]); !s.documentExists(id) {
+			stale = append(stale, append([]byte{}, key...))
+		}
+	}
+
+	for _, key := range stale {
+		if err := s.indexDb.Delete(key, pebble.Sync); err != nil {
+			log.Printf("Could not remove stale index posting %q: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"testing"
+)
+
+func pathValuesAsStrings(pvs []pathValue) []string {
+	var out []string
+	for _, pv := range pvs {
+		out = append(out, pv.path+"="+pathValueString(pv.value))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func pathValueString(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	default:
+		return "num"
+	}
+}
+
+func TestGetPathValuesArrayOfPrimitives(t *testing.T) {
+	doc := map[string]any{"tags": []interface{}{"go", "db"}}
+
+	got := pathValuesAsStrings(getPathValues(doc, ""))
+	want := []string{"tags=db", "tags=go"}
+
+	if len(got) != len(want) {
+		t.Fatalf("getPathValues(%v) = %v, want %v", doc, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("getPathValues(%v) = %v, want %v", doc, got, want)
+		}
+	}
+}
+
+func TestGetPathValuesArrayOfObjects(t *testing.T) {
+	doc := map[string]any{"authors": []interface{}{
+		map[string]any{"name": "Phil"},
+		map[string]any{"name": "Kevin"},
+	}}
+
+	got := pathValuesAsStrings(getPathValues(doc, ""))
+	want := []string{"authors.name=Kevin", "authors.name=Phil"}
+
+	if len(got) != len(want) {
+		t.Fatalf("getPathValues(%v) = %v, want %v", doc, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("getPathValues(%v) = %v, want %v", doc, got, want)
+		}
+	}
+}
+
+func TestGetPathValuesMixedTypeArray(t *testing.T) {
+	doc := map[string]any{"mixed": []interface{}{"go", 5.0, map[string]any{"name": "Phil"}}}
+
+	pvs := getPathValues(doc, "")
+
+	var sawString, sawNumber, sawNested bool
+	for _, pv := range pvs {
+		switch {
+		case pv.path == "mixed" && pv.value == "go":
+			sawString = true
+		case pv.path == "mixed" && pv.value == 5.0:
+			sawNumber = true
+		case pv.path == "mixed.name" && pv.value == "Phil":
+			sawNested = true
+		}
+	}
+
+	if !sawString || !sawNumber || !sawNested {
+		t.Fatalf("getPathValues(%v) = %v, missing one of string/number/nested entries", doc, pvs)
+	}
+}
+
+// TestEncodeNumberPreservesOrder checks the sign-bit-flipped big-endian
+// encoding that makes range scans over the numeric index sort the same
+// way as the underlying float64, including across the negative/
+// non-negative boundary.
+func TestEncodeNumberPreservesOrder(t *testing.T) {
+	values := []float64{-100, -1.5, -0.001, 0, 0.001, 1.5, 100}
+
+	for i := 1; i < len(values); i++ {
+		prev, cur := encodeNumber(values[i-1]), encodeNumber(values[i])
+		if bytes.Compare(prev, cur) >= 0 {
+			t.Fatalf("encodeNumber(%v) = %x not ordered before encodeNumber(%v) = %x", values[i-1], prev, values[i], cur)
+		}
+	}
+}
+
+// TestFlattenPathValueNaNIndexesAsString checks that NaN - which has no
+// defined sort order and so can't live in the numeric index - falls
+// back to being indexed as a string instead of being dropped.
+func TestFlattenPathValueNaNIndexesAsString(t *testing.T) {
+	pvs := flattenPathValue("score", math.NaN())
+
+	if len(pvs) != 1 {
+		t.Fatalf("flattenPathValue(score, NaN) = %v, want exactly one entry", pvs)
+	}
+	if _, ok := pvs[0].value.(string); !ok {
+		t.Fatalf("flattenPathValue(score, NaN) value is %T, want string", pvs[0].value)
+	}
+}
+
+// TestSearchMixedEqualityAndRangeQuery exercises the request's headline
+// scenario end to end: an `=` predicate served from the equality index
+// intersected with a `>` predicate served from a range scan over
+// negative and positive numbers.
+func TestSearchMixedEqualityAndRangeQuery(t *testing.T) {
+	s := newTestServer(t)
+
+	addTestDocument(t, s, map[string]any{"name": "Kevin", "age": -5.0})
+	addTestDocument(t, s, map[string]any{"name": "Kevin", "age": 30.0})
+	addTestDocument(t, s, map[string]any{"name": "Bob", "age": 30.0})
+
+	documents := searchTestDocuments(t, s, "name:Kevin age:>0")
+
+	if len(documents) != 1 {
+		t.Fatalf("expected 1 document to match, got %d: %v", len(documents), documents)
+	}
+
+	body, _ := documents[0]["body"].(map[string]any)
+	if body["name"] != "Kevin" || body["age"] != 30.0 {
+		t.Fatalf("expected Kevin/age=30 to match, got %v", body)
+	}
+}
+
+// TestLookupEqualDoesNotMatchValueContainingSeparator guards against
+// the string index key treating '/' in a value as a path continuation:
+// without a length prefix, the key for "x/y" shares a prefix with the
+// key for "x", so a lookup for "x" would wrongly match it too.
+func TestLookupEqualDoesNotMatchValueContainingSeparator(t *testing.T) {
+	s := newTestServer(t)
+
+	addTestDocument(t, s, map[string]any{"tags": []interface{}{"x/y", "z"}})
+
+	documents := searchTestDocuments(t, s, "tags:x")
+
+	if len(documents) != 0 {
+		t.Fatalf("expected tags:x not to match a tag of \"x/y\", got %v", documents)
+	}
+}
@@ -5,9 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
-	"unicode"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/google/uuid"
@@ -64,39 +62,45 @@ func (s *Server) searchDocument(w http.ResponseWriter, r *http.Request, _ httpro
 		return
 	}
 
-	isRangeScan := false
-	idsArgumentCount := map[string]int{}
-	nonRangeArguments := 0
-	for _, argument := range q.ands {
-		if argument.op == "=" {
-			nonRangeArguments++
+	if cmp, ok := q.root.(*CmpNode); ok && cmp.cmp.op == "~" {
+		hits, err := s.fullTextSearch(strings.Join(cmp.cmp.key, "."), cmp.cmp.value)
+		if err != nil {
+			jsonResponse(w, nil, err)
+			return
+		}
 
-			ids, err := s.lookup(fmt.Sprintf("%s=%v", strings.Join(argument.key, "."), argument.value))
+		documents := make([]any, 0, len(hits))
+		for _, hit := range hits {
+			document, err := s.getDocumentById([]byte(hit.id))
 			if err != nil {
 				jsonResponse(w, nil, err)
 				return
 			}
 
-			for _, id := range ids {
-				_, ok := idsArgumentCount[id]
-				if !ok {
-					idsArgumentCount[id] = 0
-				}
+			documents = append(documents, map[string]any{
+				"id":      hit.id,
+				"body":    document,
+				"score":   hit.score,
+				"matches": hit.matches,
+			})
+		}
 
-				idsArgumentCount[id]++
-			}
+		jsonResponse(w, map[string]any{
+			"documents": documents,
+			"count":     len(documents),
+		}, nil)
+		return
+	}
 
-		} else {
-			isRangeScan = true
-		}
+	plan, err := s.planIds(q.root)
+	if err != nil {
+		jsonResponse(w, nil, err)
+		return
 	}
 
-	// idsInAll contains ids which appear satisfy all equality statments
 	var idsInAll []string
-	for id, count := range idsArgumentCount {
-		if count == nonRangeArguments {
-			idsInAll = append(idsInAll, id)
-		}
+	if plan.resolved {
+		idsInAll = plan.ids
 	}
 
 	var documents []any
@@ -107,9 +111,10 @@ func (s *Server) searchDocument(w http.ResponseWriter, r *http.Request, _ httpro
 	/*
 	 The results matching the overall filter must be
 	 the set intersection of ids that match each individual
-	 equality filter.
-	 Greater than and less than filters will be filtered out
-	 after fetching all possible ids that match equality filters.
+	 predicate of an AND; OR and NOT branches take the union and
+	 the set difference instead (see planIds). A per-document match is still run as a safety net
+	 whenever the plan isn't exact, since the index only narrows
+	 candidates down to the right path/type.
 	*/
 	if len(idsInAll) > 0 {
 		for _, id := range idsInAll {
@@ -119,7 +124,7 @@ func (s *Server) searchDocument(w http.ResponseWriter, r *http.Request, _ httpro
 				return
 			}
 
-			if !isRangeScan || q.match(document) {
+			if plan.exact || q.match(document) {
 				documents = append(documents, map[string]any{
 					"id":   id,
 					"body": document,
@@ -158,129 +163,141 @@ func (s *Server) searchDocument(w http.ResponseWriter, r *http.Request, _ httpro
 	}, nil)
 }
 
-func (s *Server) lookup(pathValue string) ([]string, error) {
-	idsString, closer, err := s.indexDb.Get([]byte(pathValue))
-	if err != nil && err != pebble.ErrNotFound {
-		return nil, fmt.Errorf("Could not look up pathValue [%#v]: %s", pathValue, err)
+// updateDocument implements PUT /docs/:id: a full replace of the
+// stored document. It upserts - if id doesn't exist yet, it's
+// created - and maintains the index via replaceDocument's per-store
+// batches.
+func (s *Server) updateDocument(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	var document map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&document); err != nil {
+		jsonResponse(w, nil, err)
+		return
 	}
 
-	if closer != nil {
-		defer closer.Close()
+	oldDocument, err := s.getDocumentById([]byte(id))
+	if err != nil && err != pebble.ErrNotFound {
+		jsonResponse(w, nil, err)
+		return
 	}
 
-	if len(idsString) == 0 {
-		return nil, nil
+	if err := s.replaceDocument(id, oldDocument, document); err != nil {
+		jsonResponse(w, nil, err)
+		return
 	}
 
-	return strings.Split(string(idsString), ","), nil
+	jsonResponse(w, map[string]any{
+		"id": id,
+	}, nil)
 }
 
-func (s *Server) getDocument(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+// patchDocument implements PATCH /docs/:id as an RFC 7396 JSON Merge
+// Patch: the request body is merged into the stored document field by
+// field, with a `null` value deleting the corresponding key.
+func (s *Server) patchDocument(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	id := params.ByName("id")
 
-	document, err := s.getDocumentById([]byte(id))
+	var patch map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		jsonResponse(w, nil, err)
+		return
+	}
+
+	oldDocument, err := s.getDocumentById([]byte(id))
 	if err != nil {
 		jsonResponse(w, nil, err)
 		return
 	}
 
+	document := applyMergePatch(oldDocument, patch)
+
+	if err := s.replaceDocument(id, oldDocument, document); err != nil {
+		jsonResponse(w, nil, err)
+		return
+	}
+
 	jsonResponse(w, map[string]any{
-		"document": document,
+		"id": id,
 	}, nil)
 }
 
-func (s *Server) getDocumentById(id []byte) (map[string]any, error) {
-	valueBytes, closer, err := s.db.Get([]byte(id))
+// deleteDocument implements DELETE /docs/:id, removing both the
+// stored document and its postings via removeDocument.
+func (s *Server) deleteDocument(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	oldDocument, err := s.getDocumentById([]byte(id))
 	if err != nil {
-		return nil, err
+		jsonResponse(w, nil, err)
+		return
 	}
 
-	defer closer.Close()
-
-	var document map[string]any
-	err = json.Unmarshal(valueBytes, &document)
+	if err := s.removeDocument(id, oldDocument); err != nil {
+		jsonResponse(w, nil, err)
+		return
+	}
 
-	return document, err
+	jsonResponse(w, map[string]any{
+		"id": id,
+	}, nil)
 }
 
-func (s *Server) index(id string, document map[string]any) {
-	pathValues := getPathValues(document, "")
-
-	for _, pathValue := range pathValues {
-		idsString, closer, err := s.indexDb.Get([]byte(pathValue))
-		if err != nil && err != pebble.ErrNotFound {
-			log.Printf("Could not look up path value [%#v]: %s", document, err)
-		}
-
-		if len(idsString) == 0 {
-			idsString = []byte(id)
-		} else {
-			ids := strings.Split(string(idsString), ",")
-			found := false
-			for _, existingId := range ids {
-				if id == existingId {
-					found = true
-					break
-				}
-			}
+// applyMergePatch applies an RFC 7396 JSON Merge Patch: a patch key
+// set to `null` deletes the corresponding target key, a patch value
+// that's itself an object merges recursively, and anything else
+// (including arrays, which RFC 7396 always replaces wholesale)
+// overwrites the target value. target is mutated and returned; pass
+// nil for a target that doesn't exist yet.
+func applyMergePatch(target, patch map[string]any) map[string]any {
+	if target == nil {
+		target = map[string]any{}
+	}
 
-			if !found {
-				idsString = append(idsString, []byte(","+id)...)
-			}
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
 		}
 
-		if closer != nil {
-			err = closer.Close()
-			if err != nil {
-				log.Printf("Could not close: %s", err)
-			}
+		if patchObject, ok := value.(map[string]any); ok {
+			targetObject, _ := target[key].(map[string]any)
+			target[key] = applyMergePatch(targetObject, patchObject)
+			continue
 		}
 
-		err = s.indexDb.Set([]byte(pathValue), idsString, pebble.Sync)
-		if err != nil {
-			log.Printf("Could not update index: %s", err)
-		}
+		target[key] = value
 	}
+
+	return target
 }
 
-func getPathValues(obj map[string]any, prefix string) []string {
-	var pathValues []string
-	for key, value := range obj {
-		switch t := value.(type) {
-		case map[string]any:
-			pathValues = append(pathValues, getPathValues(t, key)...)
-			continue
-		case []interface{}:
-			// can't handle arrays
-			continue
-		}
+func (s *Server) getDocument(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
 
-		if prefix != "" {
-			key = prefix + "." + key
-		}
-		pathValues = append(pathValues, fmt.Sprintf("%s=%v", key, value))
+	document, err := s.getDocumentById([]byte(id))
+	if err != nil {
+		jsonResponse(w, nil, err)
+		return
 	}
 
-	return pathValues
+	jsonResponse(w, map[string]any{
+		"document": document,
+	}, nil)
 }
 
-// to handle documents that were ingested and not indexed
-func (s *Server) reIndex() {
-	it, err := s.db.NewIter(nil)
+func (s *Server) getDocumentById(id []byte) (map[string]any, error) {
+	valueBytes, closer, err := s.db.Get([]byte(id))
 	if err != nil {
-		log.Printf("Unable to creater iterator for db: %s", err)
+		return nil, err
 	}
-	defer it.Close()
 
-	for it.First(); it.Valid(); it.Next() {
-		var document map[string]any
-		err := json.Unmarshal(it.Value(), &document)
-		if err != nil {
-			log.Printf("Unable to parse bad document, %s: %s", string(it.Key()), err)
-		}
+	defer closer.Close()
 
-		s.index(string(it.Key()), document)
-	}
+	var document map[string]any
+	err = json.Unmarshal(valueBytes, &document)
+
+	return document, err
 }
 
 func jsonResponse(w http.ResponseWriter, body map[string]any, err error) {
@@ -326,12 +343,16 @@ func main() {
 
 	defer s.db.Close()
 
-	s.reIndex()
+	s.reIndexAndGC()
 
 	router := httprouter.New()
 	router.POST("/docs", s.addDocument)
+	router.POST("/docs/_bulk", s.bulkDocuments)
 	router.GET("/docs", s.searchDocument)
 	router.GET("/docs/:id", s.getDocument)
+	router.PUT("/docs/:id", s.updateDocument)
+	router.PATCH("/docs/:id", s.patchDocument)
+	router.DELETE("/docs/:id", s.deleteDocument)
 
 	log.Println("Listening on port: " + s.port)
 
@@ -342,198 +363,3 @@ func main() {
 		log.Fatal(err)
 	}
 }
-
-type QueryComparison struct {
-	key   []string
-	value string
-	op    string
-}
-
-type Query struct {
-	ands []QueryComparison
-}
-
-func (q *Query) match(doc map[string]any) bool {
-	for _, argument := range q.ands {
-		value, ok := getPath(doc, argument.key)
-		if !ok {
-			return false
-		}
-
-		// handle equality
-		if argument.op == "=" {
-			match := fmt.Sprint("%v", value) == argument.value
-			if !match {
-				return false
-			}
-
-			continue
-		}
-
-		// handle <, >
-		right, err := strconv.ParseFloat(argument.value, 64)
-		var left float64
-
-		switch t := value.(type) {
-		case float64:
-			left = t
-		case float32:
-			left = float64(t)
-		case uint:
-			left = float64(t)
-		case uint8:
-			left = float64(t)
-		case uint16:
-			left = float64(t)
-		case uint32:
-			left = float64(t)
-		case uint64:
-			left = float64(t)
-		case int:
-			left = float64(t)
-		case int8:
-			left = float64(t)
-		case int16:
-			left = float64(t)
-		case int32:
-			left = float64(t)
-		case int64:
-			left = float64(t)
-		case string:
-			left, err = strconv.ParseFloat(t, 64)
-			if err != nil {
-				return false
-			}
-		default:
-			return false
-		}
-
-		if argument.op == ">" {
-			if left <= right {
-				return false
-			}
-			continue
-		}
-
-		if left >= right {
-			return false
-		}
-	}
-
-	return true
-}
-
-func getPath(doc map[string]any, parts []string) (any, bool) {
-	var docSegment any = doc
-	for _, part := range parts {
-		m, ok := docSegment.(map[string]any)
-		if !ok {
-			return nil, false
-		}
-
-		if docSegment, ok = m[part]; !ok {
-			return nil, false
-		}
-	}
-
-	return docSegment, true
-}
-
-// e.g. q=a.b:12
-func parseQuery(q string) (*Query, error) {
-	if q == "" {
-		return &Query{}, nil
-	}
-
-	i := 0
-	var parsedQuery Query
-	var qRune = []rune(q)
-	for i < len(qRune) {
-		// eat whitespace
-		for unicode.IsSpace(qRune[i]) {
-			i++
-		}
-
-		key, nextIdx, err := lexString(qRune, i)
-		if err != nil {
-			return nil, fmt.Errorf("expected valid key, got [%s]: `%d", err, q[nextIdx])
-		}
-
-		// expect operator
-		if q[nextIdx] != ':' {
-			return nil, fmt.Errorf("expected colon at %d, got: %d", nextIdx, q[nextIdx])
-		}
-
-		i = nextIdx + 1
-		op := "="
-		if q[i] == '>' || q[i] == '<' {
-			op = string(q[i])
-			i++
-		}
-
-		value, nextIdx, err := lexString(qRune, i)
-		if err != nil {
-			return nil, fmt.Errorf("expected valid value, got [%s]: `%d", err, q[nextIdx])
-		}
-
-		i = nextIdx
-
-		argument := QueryComparison{
-			key:   strings.Split(key, "."),
-			value: value,
-			op:    op,
-		}
-
-		parsedQuery.ands = append(parsedQuery.ands, argument)
-	}
-
-	return &parsedQuery, nil
-}
-
-// handles either quoted strings or unquoted strings of only contiguous digits and letters
-func lexString(input []rune, idx int) (string, int, error) {
-	if idx >= len(input) {
-		return "", idx, nil
-	}
-
-	if input[idx] == '"' {
-		idx++
-
-		foundEnd := false
-		var s []rune
-		// TODO: handle nested quotes
-		for idx < len(input) {
-			if input[idx] == '"' {
-				foundEnd = true
-				break
-			}
-
-			s = append(s, input[idx])
-			idx++
-		}
-
-		if !foundEnd {
-			return "", idx, fmt.Errorf("expected end of quoted string")
-		}
-
-		return string(s), idx + 1, nil
-	}
-
-	// if unquoted, read as much contiguous digits/letters as there are
-	var s []rune
-	var c rune
-	for idx < len(input) {
-		c = input[idx]
-		if !(unicode.IsLetter((c)) || unicode.IsDigit(c) || c == '.') {
-			break
-		}
-		s = append(s, c)
-		idx++
-	}
-
-	if len(s) == 0 {
-		return "", idx, fmt.Errorf("no string found")
-	}
-
-	return string(s), idx, nil
-}
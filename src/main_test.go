@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyMergePatchSetsAndOverwritesFields(t *testing.T) {
+	target := map[string]any{"name": "Phil", "age": 30.0}
+	patch := map[string]any{"age": 31.0, "city": "SF"}
+
+	got := applyMergePatch(target, patch)
+	want := map[string]any{"name": "Phil", "age": 31.0, "city": "SF"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applyMergePatch(...) = %v, want %v", got, want)
+	}
+}
+
+func TestApplyMergePatchNullDeletesKey(t *testing.T) {
+	target := map[string]any{"name": "Phil", "age": 30.0}
+	patch := map[string]any{"age": nil}
+
+	got := applyMergePatch(target, patch)
+	want := map[string]any{"name": "Phil"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applyMergePatch(...) = %v, want %v", got, want)
+	}
+}
+
+func TestApplyMergePatchMergesNestedObjects(t *testing.T) {
+	target := map[string]any{"address": map[string]any{"city": "SF", "zip": "94110"}}
+	patch := map[string]any{"address": map[string]any{"zip": "94111"}}
+
+	got := applyMergePatch(target, patch)
+	want := map[string]any{"address": map[string]any{"city": "SF", "zip": "94111"}}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applyMergePatch(...) = %v, want %v", got, want)
+	}
+}
+
+func TestApplyMergePatchReplacesArraysWholesale(t *testing.T) {
+	target := map[string]any{"tags": []interface{}{"go", "db"}}
+	patch := map[string]any{"tags": []interface{}{"rust"}}
+
+	got := applyMergePatch(target, patch)
+	want := map[string]any{"tags": []interface{}{"rust"}}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applyMergePatch(...) = %v, want %v", got, want)
+	}
+}
+
+func TestApplyMergePatchOnMissingTarget(t *testing.T) {
+	got := applyMergePatch(nil, map[string]any{"name": "Phil"})
+	want := map[string]any{"name": "Phil"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applyMergePatch(nil, ...) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import "strings"
+
+// idPlan is the result of trying to answer a QueryNode from the
+// index. resolved is false when the node (or a descendant) can't be
+// answered from the index at all, e.g. a `~` comparison or a NOT with
+// an unresolved operand; callers should fall back to a full scan in
+// that case. exact is false when ids narrows the candidates down but
+// each one still needs a per-document match() to confirm, e.g. a
+// range comparison or anything downstream of a NOT.
+type idPlan struct {
+	ids      []string
+	exact    bool
+	resolved bool
+}
+
+// planIds walks node and, where possible, answers it from the index
+// instead of a full table scan: intersections for AND, unions for OR,
+// and a set-difference against every document id for NOT.
+func (s *Server) planIds(node QueryNode) (idPlan, error) {
+	switch n := node.(type) {
+	case *CmpNode:
+		return s.planComparison(n.cmp)
+
+	case *AndNode:
+		left, err := s.planIds(n.left)
+		if err != nil {
+			return idPlan{}, err
+		}
+		right, err := s.planIds(n.right)
+		if err != nil {
+			return idPlan{}, err
+		}
+
+		switch {
+		case !left.resolved && !right.resolved:
+			return idPlan{}, nil
+		case !left.resolved:
+			return idPlan{ids: right.ids, exact: false, resolved: true}, nil
+		case !right.resolved:
+			return idPlan{ids: left.ids, exact: false, resolved: true}, nil
+		default:
+			return idPlan{ids: intersectIds(left.ids, right.ids), exact: left.exact && right.exact, resolved: true}, nil
+		}
+
+	case *OrNode:
+		left, err := s.planIds(n.left)
+		if err != nil {
+			return idPlan{}, err
+		}
+		right, err := s.planIds(n.right)
+		if err != nil {
+			return idPlan{}, err
+		}
+		if !left.resolved || !right.resolved {
+			// a union needs both sides enumerated from the index;
+			// otherwise the unresolved side could match ids we'd
+			// never see here
+			return idPlan{}, nil
+		}
+
+		return idPlan{ids: unionIds(left.ids, right.ids), exact: left.exact && right.exact, resolved: true}, nil
+
+	case *NotNode:
+		inner, err := s.planIds(n.node)
+		if err != nil {
+			return idPlan{}, err
+		}
+		if !inner.resolved {
+			return idPlan{}, nil
+		}
+
+		allIds, err := s.allDocumentIds()
+		if err != nil {
+			return idPlan{}, err
+		}
+
+		return idPlan{ids: differenceIds(allIds, inner.ids), exact: false, resolved: true}, nil
+
+	default:
+		return idPlan{}, nil
+	}
+}
+
+func (s *Server) planComparison(c QueryComparison) (idPlan, error) {
+	if c.op == "~" {
+		// full-text containment isn't backed by the range/equality
+		// index, so let the caller fall back to a full scan
+		return idPlan{}, nil
+	}
+
+	path := strings.Join(c.key, ".")
+
+	if c.op == "=" {
+		var ids []string
+		var err error
+		if c.numeric {
+			ids, err = s.lookupEqual(path, c.numericValue)
+		} else {
+			ids, err = s.lookupEqual(path, c.value)
+		}
+		if err != nil {
+			return idPlan{}, err
+		}
+		return idPlan{ids: ids, exact: true, resolved: true}, nil
+	}
+
+	ids, err := s.lookupRange(path, c.op, c.numericValue)
+	if err != nil {
+		return idPlan{}, err
+	}
+	return idPlan{ids: ids, exact: false, resolved: true}, nil
+}
+
+func (s *Server) allDocumentIds() ([]string, error) {
+	it, err := s.db.NewIter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var ids []string
+	for it.First(); it.Valid(); it.Next() {
+		ids = append(ids, string(it.Key()))
+	}
+
+	return ids, nil
+}
+
+func intersectIds(a, b []string) []string {
+	inA := map[string]bool{}
+	for _, id := range a {
+		inA[id] = true
+	}
+
+	var result []string
+	for _, id := range b {
+		if inA[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func unionIds(a, b []string) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, id := range append(append([]string{}, a...), b...) {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func differenceIds(all, exclude []string) []string {
+	excluded := map[string]bool{}
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+
+	var result []string
+	for _, id := range all {
+		if !excluded[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type QueryComparison struct {
+	key   []string
+	value string
+	op    string
+
+	// numeric and numericValue are set by parseQuery when value parses
+	// as a non-NaN float64, so that the index lookup and the `<`/`>`
+	// comparisons don't need to re-parse it.
+	numeric      bool
+	numericValue float64
+}
+
+// QueryNode is one node of a parsed query's boolean expression tree.
+type QueryNode interface {
+	match(doc map[string]any) bool
+}
+
+type CmpNode struct {
+	cmp QueryComparison
+}
+
+type AndNode struct {
+	left, right QueryNode
+}
+
+type OrNode struct {
+	left, right QueryNode
+}
+
+type NotNode struct {
+	node QueryNode
+}
+
+func (n *CmpNode) match(doc map[string]any) bool { return matchComparison(doc, n.cmp) }
+func (n *AndNode) match(doc map[string]any) bool { return n.left.match(doc) && n.right.match(doc) }
+func (n *OrNode) match(doc map[string]any) bool  { return n.left.match(doc) || n.right.match(doc) }
+func (n *NotNode) match(doc map[string]any) bool { return !n.node.match(doc) }
+
+// Query wraps the root of a parsed boolean expression. A nil root
+// (the empty query string) matches every document.
+type Query struct {
+	root QueryNode
+}
+
+func (q *Query) match(doc map[string]any) bool {
+	if q.root == nil {
+		return true
+	}
+	return q.root.match(doc)
+}
+
+// matchComparison resolves argument.key against doc and reports
+// whether argument is satisfied. A path that resolves to an array
+// (directly, or by passing through one partway down) matches if any
+// element matches, mirroring how getPathValues flattens arrays when
+// indexing.
+func matchComparison(doc map[string]any, argument QueryComparison) bool {
+	values, ok := getPath(doc, argument.key)
+	if !ok {
+		return false
+	}
+
+	for _, value := range values {
+		if matchValue(value, argument) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchValue(value any, argument QueryComparison) bool {
+	// handle equality
+	if argument.op == "=" {
+		return fmt.Sprint(value) == argument.value
+	}
+
+	// handle full-text containment
+	if argument.op == "~" {
+		text, ok := value.(string)
+		if !ok {
+			return false
+		}
+
+		fieldTokens := map[string]bool{}
+		for _, token := range tokenize(text) {
+			fieldTokens[token] = true
+		}
+
+		for _, term := range tokenize(argument.value) {
+			if !fieldTokens[term] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// handle <, >
+	right := argument.numericValue
+	var left float64
+
+	switch t := value.(type) {
+	case float64:
+		left = t
+	case float32:
+		left = float64(t)
+	case uint:
+		left = float64(t)
+	case uint8:
+		left = float64(t)
+	case uint16:
+		left = float64(t)
+	case uint32:
+		left = float64(t)
+	case uint64:
+		left = float64(t)
+	case int:
+		left = float64(t)
+	case int8:
+		left = float64(t)
+	case int16:
+		left = float64(t)
+	case int32:
+		left = float64(t)
+	case int64:
+		left = float64(t)
+	case string:
+		var err error
+		left, err = strconv.ParseFloat(t, 64)
+		if err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if argument.op == ">" {
+		return left > right
+	}
+
+	return left < right
+}
+
+// getPath resolves parts against doc and returns every leaf value
+// reached. Arrays encountered at any point along the path - whether
+// they're the final value or an intermediate one, as with
+// `authors.name` over `authors:[{"name":"Phil"}]` - are flattened so
+// each element is walked independently; ok is false only if parts
+// can't be resolved against any element at all.
+func getPath(doc map[string]any, parts []string) ([]any, bool) {
+	values := []any{doc}
+	for _, part := range parts {
+		var next []any
+		for _, v := range values {
+			m, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			child, ok := m[part]
+			if !ok {
+				continue
+			}
+
+			next = append(next, flattenArray(child)...)
+		}
+
+		values = next
+		if len(values) == 0 {
+			return nil, false
+		}
+	}
+
+	return values, true
+}
+
+// flattenArray expands nested []interface{} values into a flat list
+// of non-array values, leaving everything else untouched.
+func flattenArray(v any) []any {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return []any{v}
+	}
+
+	var out []any
+	for _, elem := range arr {
+		out = append(out, flattenArray(elem)...)
+	}
+	return out
+}
+
+// e.g. q=a.b:12
+// e.g. q=(name:Kevin OR name:Alice) AND NOT age:<18
+//
+// Backward compatible with the original space-separated syntax, where
+// bare comparisons with no AND/OR between them are implicitly ANDed,
+// e.g. q=name:Kevin age:25.
+func parseQuery(q string) (*Query, error) {
+	if strings.TrimSpace(q) == "" {
+		return &Query{}, nil
+	}
+
+	qRune := []rune(q)
+	node, i, err := parseOr(qRune, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	i = skipSpace(qRune, i)
+	if i != len(qRune) {
+		return nil, fmt.Errorf("unexpected input at %d: %q", i, string(qRune[i:]))
+	}
+
+	return &Query{root: node}, nil
+}
+
+func parseOr(qRune []rune, i int) (QueryNode, int, error) {
+	left, i, err := parseAnd(qRune, i)
+	if err != nil {
+		return nil, i, err
+	}
+
+	for {
+		j := skipSpace(qRune, i)
+		if !hasKeywordAt(qRune, j, "OR") {
+			break
+		}
+
+		right, next, err := parseAnd(qRune, skipSpace(qRune, j+2))
+		if err != nil {
+			return nil, next, err
+		}
+
+		left, i = &OrNode{left: left, right: right}, next
+	}
+
+	return left, i, nil
+}
+
+func parseAnd(qRune []rune, i int) (QueryNode, int, error) {
+	left, i, err := parseNot(qRune, i)
+	if err != nil {
+		return nil, i, err
+	}
+
+	for {
+		j := skipSpace(qRune, i)
+		if j >= len(qRune) || qRune[j] == ')' || hasKeywordAt(qRune, j, "OR") {
+			break
+		}
+
+		explicitAnd := hasKeywordAt(qRune, j, "AND")
+		if explicitAnd {
+			j = skipSpace(qRune, j+3)
+		}
+
+		right, next, err := parseNot(qRune, j)
+		if err != nil {
+			if explicitAnd {
+				return nil, next, err
+			}
+			// nothing left that looks like another comparison to
+			// implicitly AND in; let the caller decide what's next
+			break
+		}
+
+		left, i = &AndNode{left: left, right: right}, next
+	}
+
+	return left, i, nil
+}
+
+func parseNot(qRune []rune, i int) (QueryNode, int, error) {
+	i = skipSpace(qRune, i)
+	if hasKeywordAt(qRune, i, "NOT") {
+		node, next, err := parsePrimary(qRune, skipSpace(qRune, i+3))
+		if err != nil {
+			return nil, next, err
+		}
+		return &NotNode{node: node}, next, nil
+	}
+
+	return parsePrimary(qRune, i)
+}
+
+func parsePrimary(qRune []rune, i int) (QueryNode, int, error) {
+	i = skipSpace(qRune, i)
+
+	if i < len(qRune) && qRune[i] == '(' {
+		node, next, err := parseOr(qRune, i+1)
+		if err != nil {
+			return nil, next, err
+		}
+
+		next = skipSpace(qRune, next)
+		if next >= len(qRune) || qRune[next] != ')' {
+			return nil, next, fmt.Errorf("expected closing paren at %d", next)
+		}
+
+		return node, next + 1, nil
+	}
+
+	return parseComparison(qRune, i)
+}
+
+func parseComparison(qRune []rune, i int) (QueryNode, int, error) {
+	key, nextIdx, err := lexString(qRune, i)
+	if err != nil {
+		return nil, nextIdx, fmt.Errorf("expected valid key: %s", err)
+	}
+
+	if nextIdx >= len(qRune) || qRune[nextIdx] != ':' {
+		return nil, nextIdx, fmt.Errorf("expected colon at %d", nextIdx)
+	}
+
+	i = nextIdx + 1
+	op := "="
+	if i < len(qRune) && (qRune[i] == '>' || qRune[i] == '<' || qRune[i] == '~') {
+		op = string(qRune[i])
+		i++
+	}
+
+	value, nextIdx, err := lexString(qRune, i)
+	if err != nil {
+		return nil, nextIdx, fmt.Errorf("expected valid value: %s", err)
+	}
+
+	argument := QueryComparison{
+		key:   strings.Split(key, "."),
+		value: value,
+		op:    op,
+	}
+
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(f) {
+		argument.numeric = true
+		argument.numericValue = f
+	}
+
+	if (op == ">" || op == "<") && !argument.numeric {
+		return nil, nextIdx, fmt.Errorf("range comparisons require a numeric value, got: %q", value)
+	}
+
+	return &CmpNode{cmp: argument}, nextIdx, nil
+}
+
+func skipSpace(qRune []rune, i int) int {
+	for i < len(qRune) && unicode.IsSpace(qRune[i]) {
+		i++
+	}
+	return i
+}
+
+// hasKeywordAt reports whether kw occurs at qRune[i:], followed by a
+// word boundary, so that e.g. "ORder" isn't mistaken for "OR".
+func hasKeywordAt(qRune []rune, i int, kw string) bool {
+	kwRunes := []rune(kw)
+	if i+len(kwRunes) > len(qRune) {
+		return false
+	}
+
+	for j, r := range kwRunes {
+		if qRune[i+j] != r {
+			return false
+		}
+	}
+
+	end := i + len(kwRunes)
+	return end >= len(qRune) || !(unicode.IsLetter(qRune[end]) || unicode.IsDigit(qRune[end]))
+}
+
+// handles either quoted strings or unquoted strings of only contiguous digits and letters
+func lexString(input []rune, idx int) (string, int, error) {
+	if idx >= len(input) {
+		return "", idx, nil
+	}
+
+	if input[idx] == '"' {
+		idx++
+
+		foundEnd := false
+		var s []rune
+		// TODO: handle nested quotes
+		for idx < len(input) {
+			if input[idx] == '"' {
+				foundEnd = true
+				break
+			}
+
+			s = append(s, input[idx])
+			idx++
+		}
+
+		if !foundEnd {
+			return "", idx, fmt.Errorf("expected end of quoted string")
+		}
+
+		return string(s), idx + 1, nil
+	}
+
+	// if unquoted, read as much contiguous digits/letters as there are
+	var s []rune
+	var c rune
+	for idx < len(input) {
+		c = input[idx]
+		if !(unicode.IsLetter((c)) || unicode.IsDigit(c) || c == '.') {
+			break
+		}
+		s = append(s, c)
+		idx++
+	}
+
+	if len(s) == 0 {
+		return "", idx, fmt.Errorf("no string found")
+	}
+
+	return string(s), idx, nil
+}
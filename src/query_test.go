@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func mustParseQuery(t *testing.T, q string) *Query {
+	t.Helper()
+	parsed, err := parseQuery(q)
+	if err != nil {
+		t.Fatalf("parseQuery(%q) returned error: %s", q, err)
+	}
+	return parsed
+}
+
+func TestMatchArrayOfPrimitives(t *testing.T) {
+	doc := map[string]any{"tags": []interface{}{"go", "db"}}
+
+	if !mustParseQuery(t, "tags:go").match(doc) {
+		t.Fatalf("expected tags:go to match %v", doc)
+	}
+	if !mustParseQuery(t, "tags:db").match(doc) {
+		t.Fatalf("expected tags:db to match %v", doc)
+	}
+	if mustParseQuery(t, "tags:rust").match(doc) {
+		t.Fatalf("expected tags:rust not to match %v", doc)
+	}
+}
+
+func TestMatchArrayOfObjects(t *testing.T) {
+	doc := map[string]any{"authors": []interface{}{
+		map[string]any{"name": "Phil"},
+		map[string]any{"name": "Kevin"},
+	}}
+
+	if !mustParseQuery(t, "authors.name:Phil").match(doc) {
+		t.Fatalf("expected authors.name:Phil to match %v", doc)
+	}
+	if !mustParseQuery(t, "authors.name:Kevin").match(doc) {
+		t.Fatalf("expected authors.name:Kevin to match %v", doc)
+	}
+	if mustParseQuery(t, "authors.name:Alice").match(doc) {
+		t.Fatalf("expected authors.name:Alice not to match %v", doc)
+	}
+}
+
+// TestSearchRangeQueryDedupsDocumentWithMultipleMatchingArrayElements
+// guards against a document whose array field has more than one
+// element satisfying a range predicate being returned once per
+// matching element instead of once.
+func TestSearchRangeQueryDedupsDocumentWithMultipleMatchingArrayElements(t *testing.T) {
+	s := newTestServer(t)
+
+	addTestDocument(t, s, map[string]any{"scores": []interface{}{20.0, 50.0}})
+
+	documents := searchTestDocuments(t, s, "scores:>10")
+
+	if len(documents) != 1 {
+		t.Fatalf("expected 1 document, got %d: %v", len(documents), documents)
+	}
+}
+
+func TestMatchMixedTypeArray(t *testing.T) {
+	doc := map[string]any{"mixed": []interface{}{"go", 5.0}}
+
+	if !mustParseQuery(t, "mixed:go").match(doc) {
+		t.Fatalf("expected mixed:go to match %v", doc)
+	}
+	if !mustParseQuery(t, "mixed:>3").match(doc) {
+		t.Fatalf("expected mixed:>3 to match %v", doc)
+	}
+	if mustParseQuery(t, "mixed:>10").match(doc) {
+		t.Fatalf("expected mixed:>10 not to match %v", doc)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newTestServer spins up a Server backed by Pebble databases in a
+// temp directory, so handler-level tests exercise the real index/plan
+// path instead of calling QueryNode.match directly.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	s, err := newServer(t.TempDir()+"/doc_db.data", "0")
+	if err != nil {
+		t.Fatalf("newServer: %s", err)
+	}
+	t.Cleanup(func() {
+		s.db.Close()
+		s.indexDb.Close()
+	})
+
+	return s
+}
+
+func addTestDocument(t *testing.T, s *Server, document map[string]any) {
+	t.Helper()
+
+	body, err := json.Marshal(document)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v): %s", document, err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/docs", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	s.addDocument(w, req, nil)
+
+	var resp struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding addDocument response %q: %s", w.Body.String(), err)
+	}
+	if resp.Status != "ok" {
+		t.Fatalf("addDocument(%v) returned error: %s", document, resp.Error)
+	}
+}
+
+func searchTestDocuments(t *testing.T, s *Server, q string) []map[string]any {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/docs?q="+url.QueryEscape(q), nil)
+	w := httptest.NewRecorder()
+	s.searchDocument(w, req, nil)
+
+	var resp struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Body   struct {
+			Documents []map[string]any `json:"documents"`
+		} `json:"body"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding searchDocument response %q: %s", w.Body.String(), err)
+	}
+	if resp.Status != "ok" {
+		t.Fatalf("searchDocument(q=%q) returned error: %s", q, resp.Error)
+	}
+
+	return resp.Body.Documents
+}
+
+// TestSearchMixedExactAndInexactBooleanQuery is the worked example from
+// the request that introduced OR/NOT/nested queries: an `=` predicate
+// (index-exact) ANDed with a NOT over a range predicate (not
+// index-exact), which forces searchDocument's fallback path through
+// Query.match/matchValue.
+func TestSearchMixedExactAndInexactBooleanQuery(t *testing.T) {
+	s := newTestServer(t)
+
+	addTestDocument(t, s, map[string]any{"name": "Kevin", "age": 25.0})
+	addTestDocument(t, s, map[string]any{"name": "Alice", "age": 30.0})
+	addTestDocument(t, s, map[string]any{"name": "Bob", "age": 10.0})
+
+	documents := searchTestDocuments(t, s, "(name:Kevin OR name:Alice) AND NOT age:<18")
+
+	if len(documents) != 2 {
+		t.Fatalf("expected 2 documents to match, got %d: %v", len(documents), documents)
+	}
+
+	names := map[string]bool{}
+	for _, doc := range documents {
+		body, _ := doc["body"].(map[string]any)
+		names[body["name"].(string)] = true
+	}
+	if !names["Kevin"] || !names["Alice"] {
+		t.Fatalf("expected Kevin and Alice to match, got %v", documents)
+	}
+}